@@ -0,0 +1,230 @@
+/**
+ * Copyright Johan Boer
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// manifestEntry describes one downloaded attachment, so a run can be
+// audited and diffed against later ones.
+type manifestEntry struct {
+	MessageID string `json:"messageId"`
+	Subject   string `json:"subject"`
+	From      string `json:"from"`
+	Date      string `json:"date"`
+	Filename  string `json:"filename"`
+	SHA256    string `json:"sha256"`
+	SizeBytes int    `json:"sizeBytes"`
+}
+
+// archiveWriter bundles attachments into a single file instead of writing
+// them loose into outDir.
+type archiveWriter interface {
+	writeFile(name string, data []byte, modTime time.Time) error
+	close() error
+}
+
+// newArchiveWriter opens the archive file named after the query hash and
+// current time, selecting the implementation for the given -archive kind.
+func newArchiveWriter(outDir, query, kind string) (archiveWriter, string) {
+	hash := fnv.New32a()
+	hash.Write([]byte(query))
+	base := fmt.Sprintf("%v-%v-%d", progName, hash.Sum32(), time.Now().Unix())
+
+	switch kind {
+	case "zip":
+		path := filepath.Join(outDir, base+".zip")
+		f, err := os.Create(path)
+		if err != nil {
+			log.Fatalf("Unable to create archive %v: %v", path, err)
+		}
+		return &zipArchiveWriter{f: f, w: zip.NewWriter(f)}, path
+	case "tar":
+		path := filepath.Join(outDir, base+".tar")
+		f, err := os.Create(path)
+		if err != nil {
+			log.Fatalf("Unable to create archive %v: %v", path, err)
+		}
+		return &tarArchiveWriter{f: f, w: tar.NewWriter(f)}, path
+	case "tar.gz":
+		path := filepath.Join(outDir, base+".tar.gz")
+		f, err := os.Create(path)
+		if err != nil {
+			log.Fatalf("Unable to create archive %v: %v", path, err)
+		}
+		gz := gzip.NewWriter(f)
+		return &tarArchiveWriter{f: f, gz: gz, w: tar.NewWriter(gz)}, path
+	default:
+		log.Fatalf("Unknown -archive %q, must be none, zip, tar or tar.gz", kind)
+		return nil, ""
+	}
+}
+
+type zipArchiveWriter struct {
+	f *os.File
+	w *zip.Writer
+}
+
+func (a *zipArchiveWriter) writeFile(name string, data []byte, modTime time.Time) error {
+	w, err := a.w.CreateHeader(&zip.FileHeader{
+		Name:     name,
+		Method:   zip.Deflate,
+		Modified: modTime,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+func (a *zipArchiveWriter) close() error {
+	if err := a.w.Close(); err != nil {
+		return err
+	}
+	return a.f.Close()
+}
+
+type tarArchiveWriter struct {
+	f  *os.File
+	gz *gzip.Writer
+	w  *tar.Writer
+}
+
+func (a *tarArchiveWriter) writeFile(name string, data []byte, modTime time.Time) error {
+	hdr := &tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    int64(len(data)),
+		ModTime: modTime,
+	}
+	if err := a.w.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err := a.w.Write(data)
+	return err
+}
+
+func (a *tarArchiveWriter) close() error {
+	if err := a.w.Close(); err != nil {
+		return err
+	}
+	if a.gz != nil {
+		if err := a.gz.Close(); err != nil {
+			return err
+		}
+	}
+	return a.f.Close()
+}
+
+// uniqueArchiveName applies the same collision-resolution semantics as
+// getUniqeFilename, but against the set of names already written to an
+// in-memory archive rather than the filesystem.
+func uniqueArchiveName(used map[string]bool, file string) string {
+	for {
+		if !used[file] {
+			used[file] = true
+			return file
+		}
+		matches := r.FindStringSubmatch(file)
+		if matches == nil || len(matches) != 4 {
+			log.Fatalf("Unexpected number of matches in file name regular expression: %v", matches)
+		}
+		i := 0
+		if matches[2] != "" {
+			var err error
+			i, err = strconv.Atoi(matches[2])
+			if err != nil {
+				log.Fatalf("Unexpected result of ([0-9]) match in file name regular expression: %v", matches[2])
+			}
+		}
+		file = fmt.Sprintf("%s(%v)%s", matches[1], i+1, matches[3])
+	}
+}
+
+// loadManifest reads a prior run's manifest.json from outDir, if one exists,
+// so a resumed run can merge into it instead of overwriting it with only
+// this run's entries. Returns nil if there is nothing to load yet.
+func loadManifest(outDir string) []manifestEntry {
+	data, err := ioutil.ReadFile(filepath.Join(outDir, "manifest.json"))
+	if err != nil {
+		return nil
+	}
+	var entries []manifestEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		log.Fatalf("Unable to parse existing manifest.json: %v", err)
+	}
+	return entries
+}
+
+// mergeManifest combines a prior run's manifest entries with the ones
+// produced by the current run, keyed by message and filename, so
+// manifest.json stays a complete record across resumed runs instead of
+// losing entries for messages the current run skipped. Entries from the
+// current run win on key collisions.
+func mergeManifest(prior, fresh []manifestEntry) []manifestEntry {
+	merged := make(map[string]manifestEntry, len(prior)+len(fresh))
+	var order []string
+	add := func(e manifestEntry) {
+		key := e.MessageID + "/" + e.Filename
+		if _, ok := merged[key]; !ok {
+			order = append(order, key)
+		}
+		merged[key] = e
+	}
+	for _, e := range prior {
+		add(e)
+	}
+	for _, e := range fresh {
+		add(e)
+	}
+	result := make([]manifestEntry, 0, len(order))
+	for _, key := range order {
+		result = append(result, merged[key])
+	}
+	return result
+}
+
+// writeManifest writes the manifest either as manifest.json alongside the
+// loose files in outDir, or as an entry inside the archive.
+func writeManifest(outDir string, entries []manifestEntry, archive archiveWriter) {
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		log.Fatalf("Unable to marshal manifest: %v", err)
+	}
+	if archive != nil {
+		if err := archive.writeFile("manifest.json", data, time.Now()); err != nil {
+			log.Fatalf("Unable to write manifest into archive: %v", err)
+		}
+		return
+	}
+	path := filepath.Join(outDir, "manifest.json")
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		log.Fatalf("Unable to write manifest %v: %v", path, err)
+	}
+}
@@ -0,0 +1,288 @@
+/**
+ * Copyright Johan Boer
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"golang.org/x/oauth2"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// deviceAuthURL and deviceTokenURL implement Google's OAuth 2.0 Device
+// Authorization Grant (RFC 8628), which golang.org/x/oauth2/google doesn't
+// expose an endpoint constant for.
+const (
+	deviceAuthURL  = "https://oauth2.googleapis.com/device/code"
+	deviceTokenURL = "https://oauth2.googleapis.com/token"
+)
+
+// tokenFromWeb obtains a new OAuth 2.0 token using the flow selected by
+// -auth-mode, for use on anything from a desktop with a browser to a
+// headless server or container.
+func tokenFromWeb(ctx context.Context, config *oauth2.Config) *oauth2.Token {
+	switch *authMode {
+	case "loopback":
+		return tokenFromLoopback(ctx, config)
+	case "manual":
+		return tokenFromManual(ctx, config)
+	case "device":
+		return tokenFromDevice(ctx, config)
+	default:
+		return tokenFromBrowser(ctx, config)
+	}
+}
+
+// tokenFromBrowser is the original flow: it spins up a local httptest
+// server, opens the authorization URL in the user's browser and waits for
+// the redirect carrying the code. It only works on a machine with a
+// browser that can reach localhost.
+func tokenFromBrowser(ctx context.Context, config *oauth2.Config) *oauth2.Token {
+	ch := make(chan string)
+	randState := fmt.Sprintf("st%d", time.Now().UnixNano())
+	ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/favicon.ico" {
+			http.Error(rw, "", 404)
+			return
+		}
+		if req.FormValue("state") != randState {
+			log.Printf("State doesn't match: req = %#v", req)
+			http.Error(rw, "", 500)
+			return
+		}
+		if code := req.FormValue("code"); code != "" {
+			fmt.Fprintf(rw, "<h1>Success</h1>Authorized.")
+			rw.(http.Flusher).Flush()
+			ch <- code
+			return
+		}
+		log.Printf("no code")
+		http.Error(rw, "", 500)
+	}))
+	defer ts.Close()
+
+	config.RedirectURL = ts.URL
+	authURL := config.AuthCodeURL(randState)
+	go openURL(authURL)
+	log.Printf("Authorize this app at: %s", authURL)
+	code := <-ch
+	log.Printf("Authorized")
+
+	return exchangeCode(ctx, config, code)
+}
+
+// tokenFromLoopback binds a real listener on 127.0.0.1 with a fixed
+// callback path, so it works with a redirect URI registered in the GCP
+// console ahead of time (e.g. http://127.0.0.1:PORT/oauth2/callback).
+func tokenFromLoopback(ctx context.Context, config *oauth2.Config) *oauth2.Token {
+	const callbackPath = "/oauth2/callback"
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		log.Fatalf("Unable to start loopback listener: %v", err)
+	}
+
+	ch := make(chan string)
+	randState := fmt.Sprintf("st%d", time.Now().UnixNano())
+	mux := http.NewServeMux()
+	mux.HandleFunc(callbackPath, func(rw http.ResponseWriter, req *http.Request) {
+		if req.FormValue("state") != randState {
+			log.Printf("State doesn't match: req = %#v", req)
+			http.Error(rw, "", 500)
+			return
+		}
+		if code := req.FormValue("code"); code != "" {
+			fmt.Fprintf(rw, "<h1>Success</h1>Authorized. You can close this tab.")
+			rw.(http.Flusher).Flush()
+			ch <- code
+			return
+		}
+		log.Printf("no code")
+		http.Error(rw, "", 500)
+	})
+	srv := &http.Server{Handler: mux}
+	go srv.Serve(ln)
+	defer srv.Close()
+
+	config.RedirectURL = fmt.Sprintf("http://%s%s", ln.Addr().String(), callbackPath)
+	authURL := config.AuthCodeURL(randState)
+	log.Printf("Authorize this app at: %s", authURL)
+	code := <-ch
+	log.Printf("Authorized")
+
+	return exchangeCode(ctx, config, code)
+}
+
+// tokenFromManual prints the authorization URL and reads back what the
+// user pastes, for machines with no way to receive a redirect at all (e.g.
+// authorizing from a browser on a different device than the one running
+// this program). Google retired the "urn:ietf:wg:oauth:2.0:oob" redirect in
+// 2022, so this uses the http://localhost loopback redirect URI instead,
+// which installed-app OAuth clients may use without actually binding to it:
+// the browser will fail to load the page, but the code is still right
+// there in the address bar.
+func tokenFromManual(ctx context.Context, config *oauth2.Config) *oauth2.Token {
+	config.RedirectURL = "http://localhost"
+	authURL := config.AuthCodeURL("state")
+	fmt.Printf("Go to the following link in your browser:\n%v\n\n", authURL)
+	fmt.Print("The browser will fail to load the page it redirects to - that's expected. Paste the full URL from the address bar (or just the \"code\" value from it): ")
+
+	input, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		log.Fatalf("Unable to read authorization code: %v", err)
+	}
+	return exchangeCode(ctx, config, extractCode(strings.TrimSpace(input)))
+}
+
+// extractCode pulls the "code" query parameter out of a pasted redirect
+// URL, or returns the input unchanged if it doesn't look like one, so
+// tokenFromManual accepts either the full URL or just the bare code.
+func extractCode(input string) string {
+	u, err := url.Parse(input)
+	if err != nil || u.Scheme == "" || u.RawQuery == "" {
+		return input
+	}
+	if code := u.Query().Get("code"); code != "" {
+		return code
+	}
+	return input
+}
+
+func exchangeCode(ctx context.Context, config *oauth2.Config, code string) *oauth2.Token {
+	token, err := config.Exchange(ctx, code)
+	if err != nil {
+		log.Fatalf("Token exchange error: %v", err)
+	}
+	return token
+}
+
+// deviceCodeResponse is Google's response to the device authorization
+// request, per RFC 8628 section 3.2.
+type deviceCodeResponse struct {
+	DeviceCode      string `json:"device_code"`
+	UserCode        string `json:"user_code"`
+	VerificationURL string `json:"verification_url"`
+	ExpiresIn       int    `json:"expires_in"`
+	Interval        int    `json:"interval"`
+}
+
+// deviceTokenResponse is the token endpoint's response while polling for a
+// device code grant, per RFC 8628 section 3.4/3.5.
+type deviceTokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int    `json:"expires_in"`
+	TokenType    string `json:"token_type"`
+	Error        string `json:"error"`
+}
+
+// tokenFromDevice implements the OAuth 2.0 Device Authorization Grant
+// (RFC 8628): it requests a device/user code pair, prints the user code and
+// verification URL, then polls the token endpoint until the user has
+// authorized it, the request is denied, or it expires.
+func tokenFromDevice(ctx context.Context, config *oauth2.Config) *oauth2.Token {
+	dc, err := requestDeviceCode(ctx, config)
+	if err != nil {
+		log.Fatalf("Unable to request device code: %v", err)
+	}
+
+	log.Printf("To authorize this app, go to %v and enter code: %v", dc.VerificationURL, dc.UserCode)
+
+	interval := time.Duration(dc.Interval) * time.Second
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+	deadline := time.Now().Add(time.Duration(dc.ExpiresIn) * time.Second)
+
+	for time.Now().Before(deadline) {
+		time.Sleep(interval)
+
+		tr, err := pollDeviceToken(ctx, config, dc.DeviceCode)
+		if err != nil {
+			log.Fatalf("Unable to poll for device token: %v", err)
+		}
+		switch tr.Error {
+		case "":
+			return &oauth2.Token{
+				AccessToken:  tr.AccessToken,
+				RefreshToken: tr.RefreshToken,
+				TokenType:    tr.TokenType,
+				Expiry:       time.Now().Add(time.Duration(tr.ExpiresIn) * time.Second),
+			}
+		case "authorization_pending":
+			continue
+		case "slow_down":
+			interval += 5 * time.Second
+		case "access_denied":
+			log.Fatalf("Authorization denied by user")
+		default:
+			log.Fatalf("Device authorization failed: %v", tr.Error)
+		}
+	}
+	log.Fatalf("Timed out waiting for device authorization")
+	return nil
+}
+
+func requestDeviceCode(ctx context.Context, config *oauth2.Config) (*deviceCodeResponse, error) {
+	form := url.Values{
+		"client_id": {config.ClientID},
+		"scope":     {strings.Join(config.Scopes, " ")},
+	}
+	dc := new(deviceCodeResponse)
+	if err := postForm(ctx, deviceAuthURL, form, dc); err != nil {
+		return nil, err
+	}
+	return dc, nil
+}
+
+func pollDeviceToken(ctx context.Context, config *oauth2.Config, deviceCode string) (*deviceTokenResponse, error) {
+	form := url.Values{
+		"client_id":     {config.ClientID},
+		"client_secret": {config.ClientSecret},
+		"device_code":   {deviceCode},
+		"grant_type":    {"urn:ietf:params:oauth:grant-type:device_code"},
+	}
+	tr := new(deviceTokenResponse)
+	if err := postForm(ctx, deviceTokenURL, form, tr); err != nil {
+		return nil, err
+	}
+	return tr, nil
+}
+
+func postForm(ctx context.Context, endpoint string, form url.Values, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	return json.NewDecoder(resp.Body).Decode(out)
+}
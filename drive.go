@@ -0,0 +1,102 @@
+/**
+ * Copyright Johan Boer
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+	"google.golang.org/api/drive/v3"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// exportMimeTypes maps Google-native document MIME types to the MIME type
+// they should be exported as, since Drive cannot serve their raw content.
+var exportMimeTypes = map[string]struct {
+	mimeType string
+	ext      string
+}{
+	"application/vnd.google-apps.document":     {"application/vnd.openxmlformats-officedocument.wordprocessingml.document", ".docx"},
+	"application/vnd.google-apps.spreadsheet":  {"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet", ".xlsx"},
+	"application/vnd.google-apps.presentation": {"application/vnd.openxmlformats-officedocument.presentationml.presentation", ".pptx"},
+}
+
+// Downloads all files matching the given Drive query
+func driveDownloadFiles(svc *drive.Service, query, outDir string) {
+	total := 0
+	pageToken := ""
+	for {
+		req := svc.Files.List().Q(query).Fields("nextPageToken, files(id,name,mimeType,modifiedTime)")
+		if pageToken != "" {
+			req.PageToken(pageToken)
+		}
+		r, err := req.Do()
+		if err != nil {
+			log.Fatalf("Unable to retrieve files: %v", err)
+		}
+
+		for _, f := range r.Files {
+			total++
+			log.Printf("File #%v: %v", total, f.Name)
+
+			name := f.Name
+			var rc io.ReadCloser
+			if export, ok := exportMimeTypes[f.MimeType]; ok {
+				resp, err := svc.Files.Export(f.Id, export.mimeType).Download()
+				if err != nil {
+					log.Fatalf("Error exporting file %v: %v", f.Id, err)
+				}
+				rc = resp.Body
+				name += export.ext
+			} else {
+				resp, err := svc.Files.Get(f.Id).Download()
+				if err != nil {
+					log.Fatalf("Error downloading file %v: %v", f.Id, err)
+				}
+				rc = resp.Body
+			}
+
+			name = getUniqeFilename(outDir, name)
+			fullName := filepath.Join(outDir, name)
+			out, err := os.Create(fullName)
+			if err != nil {
+				log.Fatalf("Unable to write to file %v: %v", fullName, err)
+			}
+			_, err = io.Copy(out, rc)
+			rc.Close()
+			out.Close()
+			if err != nil {
+				log.Fatalf("Error writing file %v: %v", fullName, err)
+			}
+
+			modTime, err := time.Parse(time.RFC3339, f.ModifiedTime)
+			if err != nil {
+				log.Fatalf("Unable to parse modified time of file %v: %v", f.Id, err)
+			}
+			if err = os.Chtimes(fullName, time.Now(), modTime); err != nil {
+				log.Fatalf("Cannot change timestamps of file %v: %v", fullName, err)
+			}
+			log.Printf("File #%v: %v\n", total, name)
+		}
+
+		if r.NextPageToken == "" {
+			break
+		}
+		pageToken = r.NextPageToken
+	}
+	log.Printf("Downloaded %v files\n", total)
+}
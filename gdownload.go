@@ -16,6 +16,7 @@
 package main
 
 import (
+	"crypto/sha256"
 	b64 "encoding/base64"
 	"fmt"
 	"google.golang.org/api/gmail/v1"
@@ -25,6 +26,7 @@ import (
 	"path/filepath"
 	"regexp"
 	"strconv"
+	"sync"
 	"time"
 )
 
@@ -34,69 +36,317 @@ func init() {
 	r = regexp.MustCompile(`^(.*?)(?:\(([0-9]+)\))?(\.[^\.]*)?$`)
 }
 
-// Downloads all attachments from the messages of the given gmail query
+// progressEvery controls how many processed messages pass between progress
+// log lines.
+const progressEvery = 25
+
+// attachment carries one downloaded attachment from a worker to the writer
+// goroutine.
+type attachment struct {
+	messageID    string
+	attachmentID string
+	attachmentNo int
+	filename     string
+	subject      string
+	from         string
+	data         []byte
+	sha256       string
+	internalDate int64
+}
+
+// Downloads all attachments from the messages of the given gmail query.
+// A single producer goroutine fetches the messages one at a time; a bounded
+// pool of workers fetches their attachments concurrently, while a single
+// writer goroutine serializes filesystem writes.
 func gmailDownloadAttachments(svc *gmail.Service, query string, outDir string) {
-	totalMsg, totalAtt := 0, 0
-	pageToken := ""
-	for {
-		req := svc.Users.Messages.List("me").Q(query)
-		if pageToken != "" {
-			req.PageToken(pageToken)
-		}
-		r, err := req.Do()
-		if err != nil {
-			log.Fatalf("Unable to retrieve messages: %v", err)
-		}
+	var state *downloadState
+	stateFile := stateCacheFile(query)
+	if *resume {
+		state = loadDownloadState(stateFile)
+	} else {
+		state = newDownloadState()
+	}
 
-		for _, m := range r.Messages {
-			msg, err := svc.Users.Messages.Get("me", m.Id).Do()
+	msgFormat := "full"
+	if *format != "attachments" {
+		msgFormat = "raw"
+	}
+	nameTmpl := compileNameTemplate(*nameTemplate)
+
+	msgCh := make(chan *gmail.Message, *concurrency)
+	writeCh := make(chan interface{}, *concurrency)
+
+	var totalMsg, totalAtt int32
+	var msgMu sync.Mutex
+	start := time.Now()
+
+	// Producer: paginate the message list and fetch each message's full
+	// payload (or raw RFC 822 source, for the eml/mbox/maildir formats),
+	// handing it off to the worker pool.
+	go func() {
+		defer close(msgCh)
+		pageToken := ""
+		estimate := 0
+		for {
+			req := svc.Users.Messages.List("me").Q(query)
+			if pageToken != "" {
+				req.PageToken(pageToken)
+			}
+			var resp *gmail.ListMessagesResponse
+			err := withRetry(func() error {
+				var err error
+				resp, err = req.Do()
+				return err
+			})
 			if err != nil {
-				log.Fatalf("Unable to retrieve message %v: %v", m.Id, err)
+				log.Fatalf("Unable to retrieve messages: %v", err)
 			}
+			estimate = int(resp.ResultSizeEstimate)
+
+			for _, m := range resp.Messages {
+				// For the whole-message formats, resume can skip the fetch
+				// entirely; for attachments mode we still need the full
+				// payload to know which parts to skip below.
+				if msgFormat == "raw" && *resume && state.has(m.Id) {
+					continue
+				}
+
+				var msg *gmail.Message
+				err := withRetry(func() error {
+					var err error
+					msg, err = svc.Users.Messages.Get("me", m.Id).Format(msgFormat).Do()
+					return err
+				})
+				if err != nil {
+					log.Fatalf("Unable to retrieve message %v: %v", m.Id, err)
+				}
 
-			subject := ""
-			for _, h := range msg.Payload.Headers {
-				if h.Name == "Subject" {
-					subject = h.Value
-					break
+				msgMu.Lock()
+				totalMsg++
+				n := totalMsg
+				msgMu.Unlock()
+				if n%progressEvery == 0 {
+					logProgress(int(n), estimate, start)
 				}
+
+				msgCh <- msg
+			}
+
+			if resp.NextPageToken == "" {
+				break
 			}
-			totalMsg++
-			log.Printf("Message #%v: %v", totalMsg, subject)
-
-			// Download attachment here
-			n := 1
-			for _, part := range msg.Payload.Parts {
-				if part.Filename != "" {
-					totalAtt++
-					attachmentBody, err := svc.Users.Messages.Attachments.Get("me", m.Id, part.Body.AttachmentId).Do()
+			pageToken = resp.NextPageToken
+		}
+	}()
+
+	// Worker pool: fetch and decode attachments (or decode raw messages) in
+	// parallel.
+	var workers sync.WaitGroup
+	for i := 0; i < *concurrency; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for msg := range msgCh {
+				if *format != "attachments" {
+					// Already-downloaded raw messages were filtered out by
+					// the producer before the Get call.
+					data, err := b64.URLEncoding.DecodeString(msg.Raw)
+					if err != nil {
+						log.Fatalf("Error decoding raw message %v: %v", msg.Id, err)
+					}
+					subject, from := parseMessageHeaders(data)
+					log.Printf("Message: %v", subject)
+
+					sum := sha256.Sum256(data)
+					writeCh <- rawMessage{
+						messageID:    msg.Id,
+						subject:      subject,
+						from:         from,
+						data:         data,
+						internalDate: msg.InternalDate,
+						sha256:       fmt.Sprintf("%x", sum),
+					}
+					continue
+				}
+
+				subject, from := "", ""
+				for _, h := range msg.Payload.Headers {
+					switch h.Name {
+					case "Subject":
+						subject = decodeEncodedWords(h.Value)
+					case "From":
+						from = decodeEncodedWords(h.Value)
+					}
+				}
+				log.Printf("Message: %v", subject)
+
+				n := 1
+				for _, part := range collectAttachmentParts(msg.Payload.Parts) {
+					key := msg.Id + "/" + part.Body.AttachmentId
+					if *resume && state.has(key) {
+						n++
+						continue
+					}
+
+					var body *gmail.MessagePartBody
+					err := withRetry(func() error {
+						var err error
+						body, err = svc.Users.Messages.Attachments.Get("me", msg.Id, part.Body.AttachmentId).Do()
+						return err
+					})
 					if err != nil {
 						log.Fatalf("Error retrieving attachment with id %v", part.Body.AttachmentId)
 					}
-					data, err := b64.URLEncoding.DecodeString(attachmentBody.Data)
+					data, err := b64.URLEncoding.DecodeString(body.Data)
 					if err != nil {
 						log.Fatalf("Error decoding attachment: %v", err)
 					}
-					name := getUniqeFilename(outDir, part.Filename)
-					fullName := filepath.Join(outDir, name)
-					if err = ioutil.WriteFile(fullName, data, 0644); err != nil {
-						log.Fatalf("Unable to write to file %v", fullName)
-					}
-					if err = os.Chtimes(fullName, time.Now(), time.Unix(msg.InternalDate/1000, 0)); err != nil {
-						log.Fatalf("Cannot change timestamps of file %v: %v", fullName, err)
+
+					origName := decodeFilename(part.Filename)
+					name := renderFilename(nameTmpl, nameTemplateData{
+						Date:      time.Unix(msg.InternalDate/1000, 0),
+						From:      from,
+						Subject:   subject,
+						MessageID: msg.Id,
+						OrigName:  origName,
+						Ext:       filepath.Ext(origName),
+						Index:     n,
+					})
+
+					sum := sha256.Sum256(data)
+					writeCh <- attachment{
+						messageID:    msg.Id,
+						attachmentID: part.Body.AttachmentId,
+						attachmentNo: n,
+						filename:     name,
+						subject:      subject,
+						from:         from,
+						data:         data,
+						sha256:       fmt.Sprintf("%x", sum),
+						internalDate: msg.InternalDate,
 					}
-					log.Printf("Message #%v attachment #%v: %v\n", totalMsg, n, name)
 					n++
 				}
 			}
+		}()
+	}
+
+	go func() {
+		workers.Wait()
+		close(writeCh)
+	}()
+
+	var mboxW *mboxWriter
+	if *format == "mbox" {
+		mboxW = newMboxWriter(mboxFile(outDir, query))
+		defer mboxW.close()
+	}
+
+	var archiveW archiveWriter
+	archivedNames := make(map[string]bool)
+	var manifest []manifestEntry
+	if *format == "attachments" && *archive != "none" {
+		var path string
+		archiveW, path = newArchiveWriter(outDir, query, *archive)
+		log.Printf("Archiving attachments into %v", path)
+	}
+
+	// Writer: the only goroutine that touches the filesystem, so
+	// getUniqeFilename stays race-free.
+	for job := range writeCh {
+		switch j := job.(type) {
+		case attachment:
+			var name string
+			if archiveW != nil {
+				name = uniqueArchiveName(archivedNames, j.filename)
+				if err := archiveW.writeFile(name, j.data, time.Unix(j.internalDate/1000, 0)); err != nil {
+					log.Fatalf("Unable to write %v into archive: %v", name, err)
+				}
+			} else {
+				name = getUniqeFilename(outDir, j.filename)
+				fullName := filepath.Join(outDir, name)
+				if err := ioutil.WriteFile(fullName, j.data, 0644); err != nil {
+					log.Fatalf("Unable to write to file %v", fullName)
+				}
+				if err := os.Chtimes(fullName, time.Now(), time.Unix(j.internalDate/1000, 0)); err != nil {
+					log.Fatalf("Cannot change timestamps of file %v: %v", fullName, err)
+				}
+			}
+			totalAtt++
+			log.Printf("Message %v attachment #%v: %v\n", j.messageID, j.attachmentNo, name)
+
+			manifest = append(manifest, manifestEntry{
+				MessageID: j.messageID,
+				Subject:   j.subject,
+				From:      j.from,
+				Date:      time.Unix(j.internalDate/1000, 0).UTC().Format(time.RFC3339),
+				Filename:  name,
+				SHA256:    j.sha256,
+				SizeBytes: len(j.data),
+			})
+
+			if *resume {
+				state.mark(j.messageID+"/"+j.attachmentID, j.sha256)
+				state.save(stateFile)
+			}
+		case rawMessage:
+			var name string
+			switch *format {
+			case "eml":
+				name = writeEml(outDir, j)
+			case "mbox":
+				name = mboxW.write(j)
+			case "maildir":
+				name = writeMaildir(outDir, j)
+			}
+
+			manifest = append(manifest, manifestEntry{
+				MessageID: j.messageID,
+				Subject:   j.subject,
+				From:      j.from,
+				Date:      time.Unix(j.internalDate/1000, 0).UTC().Format(time.RFC3339),
+				Filename:  name,
+				SHA256:    j.sha256,
+				SizeBytes: len(j.data),
+			})
+
+			if *resume {
+				state.mark(j.messageID, j.sha256)
+				state.save(stateFile)
+			}
 		}
+	}
 
-		if r.NextPageToken == "" {
-			break
+	if *resume {
+		// A resumed run only produces entries for messages it didn't skip,
+		// so merge them into the prior manifest rather than overwriting it.
+		manifest = mergeManifest(loadManifest(outDir), manifest)
+	}
+	writeManifest(outDir, manifest, archiveW)
+	if archiveW != nil {
+		if err := archiveW.close(); err != nil {
+			log.Fatalf("Unable to close archive: %v", err)
 		}
-		pageToken = r.NextPageToken
 	}
-	log.Printf("Downloaded %v attachments from %v messages\n", totalAtt, totalMsg)
+	if *format == "attachments" {
+		log.Printf("Downloaded %v attachments from %v messages\n", totalAtt, totalMsg)
+	} else {
+		log.Printf("Downloaded %v messages\n", totalMsg)
+	}
+}
+
+// logProgress prints how many messages have been processed so far, at what
+// rate, and the estimated time remaining based on the Gmail API's result
+// size estimate for the query.
+func logProgress(done, estimate int, start time.Time) {
+	elapsed := time.Since(start)
+	rate := float64(done) / elapsed.Seconds()
+	msg := fmt.Sprintf("Progress: %v messages (%.2f msg/s)", done, rate)
+	if estimate > done && rate > 0 {
+		eta := time.Duration(float64(estimate-done)/rate) * time.Second
+		msg += fmt.Sprintf(", ~%v remaining, ETA %v", estimate-done, eta.Round(time.Second))
+	}
+	log.Print(msg)
 }
 
 func getUniqeFilename(path, file string) string {
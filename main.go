@@ -10,25 +10,23 @@ package main
 
 import (
 	"context"
-	"encoding/gob"
 	"errors"
 	"flag"
 	"fmt"
 	"golang.org/x/oauth2/google"
+	"google.golang.org/api/drive/v3"
 	"google.golang.org/api/gmail/v1"
 	"google.golang.org/api/option"
 	"hash/fnv"
 	"io/ioutil"
 	"log"
 	"net/http"
-	"net/http/httptest"
 	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"runtime"
 	"strings"
-	"time"
 
 	"golang.org/x/oauth2"
 )
@@ -39,6 +37,14 @@ var (
 	outDir          = flag.String("o", ".", "Output directory")
 	cacheToken      = flag.Bool("cachetoken", false, "Cache the OAuth 2.0 token for later invocations of the program")
 	debug           = flag.Bool("debug", false, "Show HTTP traffic")
+	source          = flag.String("source", "gmail", "Data source to download from: gmail or drive")
+	concurrency     = flag.Int("concurrency", 4, "Number of workers fetching attachments concurrently; messages themselves are fetched one at a time (gmail source only)")
+	resume          = flag.Bool("resume", false, "Skip attachments (or, for the eml, mbox and maildir formats, messages) already downloaded in a previous run")
+	format          = flag.String("format", "attachments", "What to save for each gmail message: attachments, eml, mbox or maildir")
+	tokenStoreName  = flag.String("token-store", "file", "Where to persist the OAuth 2.0 token: file, keyring or encrypted-file")
+	authMode        = flag.String("auth-mode", "browser", "How to obtain authorization: browser, loopback, device or manual")
+	archive         = flag.String("archive", "none", "Bundle downloaded attachments into a single archive instead of loose files: none, zip, tar or tar.gz (attachments format only)")
+	nameTemplate    = flag.String("name-template", "{{.OrigName}}", "Go text/template for attachment filenames, with access to .Date .From .Subject .MessageID .OrigName .Ext .Index and funcs slug/lower/trunc/sha1/dateFmt")
 )
 
 var (
@@ -67,6 +73,44 @@ func main() {
 	}
 	query := flag.Arg(0)
 
+	switch *format {
+	case "attachments", "eml", "mbox", "maildir":
+	default:
+		log.Fatalf("Unknown -format %q, must be attachments, eml, mbox or maildir", *format)
+	}
+
+	switch *tokenStoreName {
+	case "file", "keyring", "encrypted-file":
+	default:
+		log.Fatalf("Unknown -token-store %q, must be file, keyring or encrypted-file", *tokenStoreName)
+	}
+
+	switch *authMode {
+	case "browser", "loopback", "device", "manual":
+	default:
+		log.Fatalf("Unknown -auth-mode %q, must be browser, loopback, device or manual", *authMode)
+	}
+
+	switch *archive {
+	case "none", "zip", "tar", "tar.gz":
+	default:
+		log.Fatalf("Unknown -archive %q, must be none, zip, tar or tar.gz", *archive)
+	}
+
+	if *concurrency < 1 {
+		log.Fatalf("-concurrency must be at least 1, got %v", *concurrency)
+	}
+
+	if *archive != "none" && *format != "attachments" {
+		log.Fatalf("-archive is only supported with -format=attachments, not %q", *format)
+	}
+
+	if *resume && *archive != "none" {
+		log.Fatalf("-resume cannot be combined with -archive: a resumed run has no copy of previously-downloaded attachment bytes to include in a new archive")
+	}
+
+	compileNameTemplate(*nameTemplate) // fail fast on an invalid -name-template
+
 	if credentials == nil {
 		var err error
 		credentials, err = ioutil.ReadFile(*credentialsFile)
@@ -76,7 +120,7 @@ func main() {
 	}
 
 	// If modifying these scopes, delete your previously saved token.json.
-	config, err := google.ConfigFromJSON(credentials, gmail.GmailReadonlyScope)
+	config, err := google.ConfigFromJSON(credentials, scopeForSource(*source))
 	if err != nil {
 		log.Fatalf("Unable to parse credentials file to config: %v", err)
 	}
@@ -88,12 +132,33 @@ func main() {
 		})
 	}
 	c := newOAuthClient(ctx, config)
-	svc, err := gmail.NewService(ctx, option.WithHTTPClient(c))
-	if err != nil {
-		log.Fatalf("Unable to create Gmail service: %v", err)
+
+	switch *source {
+	case "gmail":
+		svc, err := gmail.NewService(ctx, option.WithHTTPClient(c))
+		if err != nil {
+			log.Fatalf("Unable to create Gmail service: %v", err)
+		}
+		gmailDownloadAttachments(svc, query, *outDir)
+	case "drive":
+		svc, err := drive.NewService(ctx, option.WithHTTPClient(c))
+		if err != nil {
+			log.Fatalf("Unable to create Drive service: %v", err)
+		}
+		driveDownloadFiles(svc, query, *outDir)
+	default:
+		log.Fatalf("Unknown -source %q, must be gmail or drive", *source)
 	}
+}
 
-	gmailDownloadAttachments(svc, query, *outDir)
+// scopeForSource returns the OAuth scope required for the given -source value.
+func scopeForSource(source string) string {
+	switch source {
+	case "drive":
+		return drive.DriveReadonlyScope
+	default:
+		return gmail.GmailReadonlyScope
+	}
 }
 
 func osUserCacheDir() string {
@@ -102,101 +167,53 @@ func osUserCacheDir() string {
 		return filepath.Join(os.Getenv("HOME"), "Library", "Caches")
 	case "linux", "freebsd":
 		return filepath.Join(os.Getenv("HOME"), ".cache")
+	case "windows":
+		return os.Getenv("LocalAppData")
 	}
 	log.Printf("TODO: osUserCacheDir on GOOS %q", runtime.GOOS)
 	return "."
 }
 
-func tokenCacheFile(config *oauth2.Config) string {
+// tokenStoreKey returns the identifier a TokenStore uses to namespace the
+// token for this credentials/scopes combination.
+func tokenStoreKey(config *oauth2.Config) string {
 	hash := fnv.New32a()
 	hash.Write([]byte(config.ClientID))
 	hash.Write([]byte(config.ClientSecret))
 	hash.Write([]byte(strings.Join(config.Scopes, " ")))
 	fn := fmt.Sprintf("%v-tok%v", progName, hash.Sum32())
-	return filepath.Join(osUserCacheDir(), url.QueryEscape(fn))
+	return url.QueryEscape(fn)
 }
 
-func tokenFromFile(file string) (*oauth2.Token, error) {
-	if !*cacheToken {
-		return nil, errors.New("--cachetoken is false")
-	}
-	f, err := os.Open(file)
-	if err != nil {
-		return nil, err
-	}
-	t := new(oauth2.Token)
-	err = gob.NewDecoder(f).Decode(t)
-	return t, err
-}
+func newOAuthClient(ctx context.Context, config *oauth2.Config) *http.Client {
+	store := newTokenStore(*tokenStoreName)
+	key := tokenStoreKey(config)
 
-func saveToken(file string, token *oauth2.Token) {
-	f, err := os.Create(file)
-	if err != nil {
-		log.Printf("Warning: failed to cache oauth token: %v", err)
-		return
+	var token *oauth2.Token
+	err := errors.New("--cachetoken is false")
+	if *cacheToken {
+		token, err = store.Load(key)
 	}
-	defer f.Close()
-	gob.NewEncoder(f).Encode(token)
-	log.Printf("Saved oauth token for later use in file: %v", file)
-}
-
-func newOAuthClient(ctx context.Context, config *oauth2.Config) *http.Client {
-	cacheFile := tokenCacheFile(config)
-	token, err := tokenFromFile(cacheFile)
 	if err != nil {
 		token = tokenFromWeb(ctx, config)
 		if *cacheToken {
-			saveToken(cacheFile, token)
+			if err := store.Save(key, token); err != nil {
+				log.Printf("Warning: failed to cache oauth token: %v", err)
+			} else {
+				log.Printf("Saved oauth token for later use in %v token store", *tokenStoreName)
+			}
 		}
 	} else {
 		if *debug {
-			log.Printf("Using cached token %#v from %q", token, cacheFile)
+			log.Printf("Using cached token %#v from %v token store", token, *tokenStoreName)
 		} else {
-			log.Printf("Using cached token from %q", cacheFile)
+			log.Printf("Using cached token from %v token store", *tokenStoreName)
 		}
 	}
 
 	return config.Client(ctx, token)
 }
 
-func tokenFromWeb(ctx context.Context, config *oauth2.Config) *oauth2.Token {
-	ch := make(chan string)
-	randState := fmt.Sprintf("st%d", time.Now().UnixNano())
-	ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
-		if req.URL.Path == "/favicon.ico" {
-			http.Error(rw, "", 404)
-			return
-		}
-		if req.FormValue("state") != randState {
-			log.Printf("State doesn't match: req = %#v", req)
-			http.Error(rw, "", 500)
-			return
-		}
-		if code := req.FormValue("code"); code != "" {
-			fmt.Fprintf(rw, "<h1>Success</h1>Authorized.")
-			rw.(http.Flusher).Flush()
-			ch <- code
-			return
-		}
-		log.Printf("no code")
-		http.Error(rw, "", 500)
-	}))
-	defer ts.Close()
-
-	config.RedirectURL = ts.URL
-	authURL := config.AuthCodeURL(randState)
-	go openURL(authURL)
-	log.Printf("Authorize this app at: %s", authURL)
-	code := <-ch
-	log.Printf("Authorized")
-
-	token, err := config.Exchange(ctx, code)
-	if err != nil {
-		log.Fatalf("Token exchange error: %v", err)
-	}
-	return token
-}
-
 func openURL(url string) {
 	try := []string{"xdg-open", "google-chrome", "open"}
 	for _, bin := range try {
@@ -0,0 +1,54 @@
+/**
+ * Copyright Johan Boer
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+	"google.golang.org/api/gmail/v1"
+	"mime"
+)
+
+// collectAttachmentParts walks the MIME tree of a message, following the
+// Parts of multipart/related, multipart/alternative and forwarded
+// message/rfc822 parts, and returns every part that carries a filename.
+func collectAttachmentParts(parts []*gmail.MessagePart) []*gmail.MessagePart {
+	var result []*gmail.MessagePart
+	for _, part := range parts {
+		if part.Filename != "" {
+			result = append(result, part)
+		}
+		if len(part.Parts) > 0 {
+			result = append(result, collectAttachmentParts(part.Parts)...)
+		}
+	}
+	return result
+}
+
+// decodeEncodedWords decodes RFC 2047 encoded-word header values
+// (e.g. "=?UTF-8?B?...?=") into plain UTF-8, falling back to the original
+// string if it isn't encoded or fails to decode.
+func decodeEncodedWords(s string) string {
+	dec := new(mime.WordDecoder)
+	decoded, err := dec.DecodeHeader(s)
+	if err != nil {
+		return s
+	}
+	return decoded
+}
+
+// decodeFilename decodes an RFC 2047 encoded-word attachment filename.
+func decodeFilename(name string) string {
+	return decodeEncodedWords(name)
+}
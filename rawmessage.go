@@ -0,0 +1,158 @@
+/**
+ * Copyright Johan Boer
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"log"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// mboxFile returns the path of the single mbox file that all messages
+// matching query are appended to, namespaced by the query like
+// stateCacheFile so distinct searches don't share a file.
+func mboxFile(outDir, query string) string {
+	hash := fnv.New32a()
+	hash.Write([]byte(query))
+	return filepath.Join(outDir, fmt.Sprintf("%v-%v.mbox", progName, hash.Sum32()))
+}
+
+// rawMessage carries a fully downloaded message (base64url-decoded from the
+// Gmail API's Format("raw")) to the writer goroutine.
+type rawMessage struct {
+	messageID    string
+	subject      string
+	from         string
+	data         []byte
+	internalDate int64
+	sha256       string
+}
+
+// parseMessageHeaders extracts the Subject and From headers from a raw
+// RFC 822 message, for logging and the manifest. Format("raw") messages
+// don't carry a parsed Payload, so these have to come from the raw bytes.
+func parseMessageHeaders(data []byte) (subject, from string) {
+	m, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return "", ""
+	}
+	subject = decodeEncodedWords(m.Header.Get("Subject"))
+	if addrs, err := m.Header.AddressList("From"); err == nil && len(addrs) > 0 {
+		from = addrs[0].Address
+	} else {
+		from = m.Header.Get("From")
+	}
+	return subject, from
+}
+
+// mboxWriter appends raw messages to a single mbox file, serialized behind
+// the same writer goroutine that handles all other filesystem access.
+type mboxWriter struct {
+	f *os.File
+}
+
+func newMboxWriter(path string) *mboxWriter {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Fatalf("Unable to open mbox file %v: %v", path, err)
+	}
+	return &mboxWriter{f: f}
+}
+
+func (w *mboxWriter) close() {
+	w.f.Close()
+}
+
+// write appends one message to the mbox file, prefixed with the
+// traditional "From " envelope separator line, and returns the mbox file's
+// own path since all messages share one file.
+func (w *mboxWriter) write(raw rawMessage) string {
+	from := raw.from
+	if from == "" {
+		from = "MAILER-DAEMON"
+	}
+	date := time.Unix(raw.internalDate/1000, 0).UTC().Format("Mon Jan 2 15:04:05 2006")
+
+	if _, err := fmt.Fprintf(w.f, "From %s %s\n", from, date); err != nil {
+		log.Fatalf("Unable to write to mbox file: %v", err)
+	}
+	if _, err := w.f.Write(escapeMboxFromLines(raw.data)); err != nil {
+		log.Fatalf("Unable to write to mbox file: %v", err)
+	}
+	if _, err := w.f.Write([]byte("\n")); err != nil {
+		log.Fatalf("Unable to write to mbox file: %v", err)
+	}
+	return w.f.Name()
+}
+
+// escapeMboxFromLines prefixes any body line starting with "From " with a
+// ">" so it isn't mistaken for the next message's envelope separator, as is
+// customary for the mbox format.
+func escapeMboxFromLines(data []byte) []byte {
+	lines := bytes.Split(data, []byte("\n"))
+	for i, line := range lines {
+		if bytes.HasPrefix(line, []byte("From ")) {
+			lines[i] = append([]byte(">"), line...)
+		}
+	}
+	return bytes.Join(lines, []byte("\n"))
+}
+
+// writeEml saves a raw message as its own .eml file and returns its name.
+func writeEml(outDir string, raw rawMessage) string {
+	name := getUniqeFilename(outDir, raw.messageID+".eml")
+	fullName := filepath.Join(outDir, name)
+	if err := writeFileWithTimes(fullName, raw.data, raw.internalDate); err != nil {
+		log.Fatalf("%v", err)
+	}
+	log.Printf("Message %v: %v\n", raw.messageID, name)
+	return name
+}
+
+// writeMaildir saves a raw message into a maildir's cur/ directory,
+// creating the standard tmp/new/cur layout under outDir if needed, and
+// returns its path relative to outDir.
+func writeMaildir(outDir string, raw rawMessage) string {
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(outDir, sub), 0755); err != nil {
+			log.Fatalf("Unable to create maildir directory %v: %v", sub, err)
+		}
+	}
+	name := fmt.Sprintf("%d.%s.gdownload:2,S", raw.internalDate/1000, raw.messageID)
+	fullName := filepath.Join(outDir, "cur", name)
+	if err := writeFileWithTimes(fullName, raw.data, raw.internalDate); err != nil {
+		log.Fatalf("%v", err)
+	}
+	relName := filepath.Join("cur", name)
+	log.Printf("Message %v: %v\n", raw.messageID, relName)
+	return relName
+}
+
+func writeFileWithTimes(fullName string, data []byte, internalDate int64) error {
+	if err := ioutil.WriteFile(fullName, data, 0644); err != nil {
+		return fmt.Errorf("unable to write to file %v: %v", fullName, err)
+	}
+	if err := os.Chtimes(fullName, time.Now(), time.Unix(internalDate/1000, 0)); err != nil {
+		return fmt.Errorf("cannot change timestamps of file %v: %v", fullName, err)
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+/**
+ * Copyright Johan Boer
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+	"errors"
+	"math/rand"
+	"time"
+
+	"google.golang.org/api/googleapi"
+)
+
+const (
+	maxRetryAttempts = 6
+	initialBackoff   = 500 * time.Millisecond
+	maxBackoff       = 30 * time.Second
+)
+
+// withRetry calls fn, retrying with exponential backoff and jitter when it
+// fails with a rate-limit (429) or server (5xx) error from the Gmail API.
+func withRetry(fn func() error) error {
+	backoff := initialBackoff
+	var err error
+	for attempt := 0; attempt < maxRetryAttempts; attempt++ {
+		if err = fn(); err == nil {
+			return nil
+		}
+		if !isRetryable(err) || attempt == maxRetryAttempts-1 {
+			return err
+		}
+		sleep := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2+1)))
+		time.Sleep(sleep)
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+	return err
+}
+
+func isRetryable(err error) bool {
+	var gerr *googleapi.Error
+	if errors.As(err, &gerr) {
+		return gerr.Code == 429 || gerr.Code >= 500
+	}
+	return false
+}
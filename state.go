@@ -0,0 +1,95 @@
+/**
+ * Copyright Johan Boer
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// downloadState tracks attachments (or, for the eml, mbox and maildir
+// formats, whole messages) already downloaded by a previous run of
+// gdownload, so that a -resume run can skip them. It is keyed on
+// "<messageID>/<attachmentID>" for attachments and on "<messageID>" for
+// whole messages, and maps to the sha256 of the downloaded data.
+type downloadState struct {
+	mu   sync.Mutex
+	Done map[string]string `json:"done"`
+}
+
+func newDownloadState() *downloadState {
+	return &downloadState{Done: make(map[string]string)}
+}
+
+// stateCacheFile returns the path of the state file for a given query,
+// namespaced by the query so distinct searches don't share resume state.
+func stateCacheFile(query string) string {
+	hash := fnv.New32a()
+	hash.Write([]byte(query))
+	fn := fmt.Sprintf("%v-state%v.json", progName, hash.Sum32())
+	return filepath.Join(osUserCacheDir(), fn)
+}
+
+func loadDownloadState(file string) *downloadState {
+	state := newDownloadState()
+	f, err := os.Open(file)
+	if err != nil {
+		return state
+	}
+	defer f.Close()
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		log.Printf("Warning: failed to read resume state %v: %v", file, err)
+		return state
+	}
+	if err := json.Unmarshal(data, state); err != nil {
+		log.Printf("Warning: failed to parse resume state %v: %v", file, err)
+		return newDownloadState()
+	}
+	return state
+}
+
+func (s *downloadState) has(key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.Done[key]
+	return ok
+}
+
+func (s *downloadState) mark(key, sha256 string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Done[key] = sha256
+}
+
+func (s *downloadState) save(file string) {
+	s.mu.Lock()
+	data, err := json.Marshal(s)
+	s.mu.Unlock()
+	if err != nil {
+		log.Printf("Warning: failed to marshal resume state: %v", err)
+		return
+	}
+	if err := ioutil.WriteFile(file, data, 0644); err != nil {
+		log.Printf("Warning: failed to save resume state %v: %v", file, err)
+	}
+}
@@ -0,0 +1,116 @@
+/**
+ * Copyright Johan Boer
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"log"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// nameTemplateData is the data made available to the -name-template
+// template for every attachment.
+type nameTemplateData struct {
+	Date      time.Time
+	From      string
+	Subject   string
+	MessageID string
+	OrigName  string
+	Ext       string
+	Index     int
+}
+
+var nonSlugChars = regexp.MustCompile(`[^a-z0-9]+`)
+
+var nameTemplateFuncs = template.FuncMap{
+	"slug": func(s string) string {
+		s = nonSlugChars.ReplaceAllString(strings.ToLower(s), "-")
+		return strings.Trim(s, "-")
+	},
+	"lower": strings.ToLower,
+	"trunc": func(n int, s string) string {
+		runes := []rune(s)
+		if len(runes) <= n {
+			return s
+		}
+		return string(runes[:n])
+	},
+	"sha1": func(s string) string {
+		sum := sha1.Sum([]byte(s))
+		return fmt.Sprintf("%x", sum)
+	},
+	"dateFmt": func(layout string, t time.Time) string {
+		return t.Format(layout)
+	},
+}
+
+// compileNameTemplate parses the -name-template flag value once, so every
+// attachment reuses the same *template.Template.
+func compileNameTemplate(tmplString string) *template.Template {
+	tmpl, err := template.New("name").Funcs(nameTemplateFuncs).Parse(tmplString)
+	if err != nil {
+		log.Fatalf("Invalid -name-template %q: %v", tmplString, err)
+	}
+	return tmpl
+}
+
+// renderFilename executes tmpl against data and sanitizes the result so it
+// is safe to join with outDir.
+func renderFilename(tmpl *template.Template, data nameTemplateData) string {
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		log.Fatalf("Unable to render -name-template: %v", err)
+	}
+	return sanitizeFilename(buf.String())
+}
+
+// windowsReservedNames are device names Windows refuses to use as file
+// names, with or without an extension.
+var windowsReservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true,
+	"COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true,
+	"LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+var controlChars = regexp.MustCompile(`[\x00-\x1f]`)
+
+// sanitizeFilename replaces path separators with underscores and strips
+// control characters from a rendered filename, and works around Windows'
+// reserved device names.
+func sanitizeFilename(name string) string {
+	name = strings.ReplaceAll(name, string(filepath.Separator), "_")
+	name = strings.ReplaceAll(name, "/", "_")
+	name = strings.ReplaceAll(name, "\\", "_")
+	name = controlChars.ReplaceAllString(name, "")
+	name = strings.TrimSpace(name)
+	if name == "" {
+		name = "attachment"
+	}
+
+	base := strings.TrimSuffix(name, filepath.Ext(name))
+	if windowsReservedNames[strings.ToUpper(base)] {
+		name = "_" + name
+	}
+	return name
+}
@@ -0,0 +1,226 @@
+/**
+ * Copyright Johan Boer
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	b64 "encoding/base64"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"github.com/zalando/go-keyring"
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/oauth2"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// TokenStore persists and retrieves the OAuth 2.0 token used to authorize
+// Gmail/Drive requests across invocations of the program.
+type TokenStore interface {
+	Load(key string) (*oauth2.Token, error)
+	Save(key string, tok *oauth2.Token) error
+}
+
+// newTokenStore returns the TokenStore implementation selected by the
+// -token-store flag.
+func newTokenStore(name string) TokenStore {
+	switch name {
+	case "keyring":
+		return keyringTokenStore{}
+	case "encrypted-file":
+		return encryptedFileTokenStore{}
+	case "file":
+		return fileTokenStore{}
+	default:
+		log.Fatalf("Unknown -token-store %q, must be file, keyring or encrypted-file", name)
+		return nil
+	}
+}
+
+func encodeToken(tok *oauth2.Token) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(tok); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeToken(data []byte) (*oauth2.Token, error) {
+	tok := new(oauth2.Token)
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(tok); err != nil {
+		return nil, err
+	}
+	return tok, nil
+}
+
+// fileTokenStore stores the token as a plaintext gob file in osUserCacheDir.
+// It is the historical, default storage.
+type fileTokenStore struct{}
+
+func (fileTokenStore) path(key string) string {
+	return filepath.Join(osUserCacheDir(), key)
+}
+
+func (s fileTokenStore) Load(key string) (*oauth2.Token, error) {
+	data, err := ioutil.ReadFile(s.path(key))
+	if err != nil {
+		return nil, err
+	}
+	return decodeToken(data)
+}
+
+func (s fileTokenStore) Save(key string, tok *oauth2.Token) error {
+	data, err := encodeToken(tok)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(s.path(key), data, 0600)
+}
+
+// keyringTokenStore stores the token in the OS-native credential store:
+// Keychain on darwin, Secret Service on linux, Credential Manager on
+// windows, via github.com/zalando/go-keyring.
+type keyringTokenStore struct{}
+
+func (keyringTokenStore) Load(key string) (*oauth2.Token, error) {
+	encoded, err := keyring.Get(progName, key)
+	if err != nil {
+		return nil, err
+	}
+	data, err := b64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	return decodeToken(data)
+}
+
+func (keyringTokenStore) Save(key string, tok *oauth2.Token) error {
+	data, err := encodeToken(tok)
+	if err != nil {
+		return err
+	}
+	return keyring.Set(progName, key, b64.StdEncoding.EncodeToString(data))
+}
+
+// encryptedFileTokenStore stores the token AES-GCM-encrypted under a key
+// derived via scrypt from a passphrase, either from
+// GDOWNLOAD_TOKEN_PASSPHRASE or an interactive prompt.
+type encryptedFileTokenStore struct{}
+
+const (
+	scryptN      = 1 << 15
+	scryptR      = 8
+	scryptP      = 1
+	scryptKeyLen = 32
+	saltLen      = 16
+)
+
+func (encryptedFileTokenStore) path(key string) string {
+	return filepath.Join(osUserCacheDir(), key+".enc")
+}
+
+func tokenPassphrase() (string, error) {
+	if p := os.Getenv("GDOWNLOAD_TOKEN_PASSPHRASE"); p != "" {
+		return p, nil
+	}
+	fmt.Fprint(os.Stderr, "Enter token store passphrase: ")
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return "", fmt.Errorf("unable to read passphrase: %v", err)
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func (s encryptedFileTokenStore) Load(key string) (*oauth2.Token, error) {
+	blob, err := ioutil.ReadFile(s.path(key))
+	if err != nil {
+		return nil, err
+	}
+	if len(blob) < saltLen {
+		return nil, errors.New("encrypted token file is truncated")
+	}
+	salt, rest := blob[:saltLen], blob[saltLen:]
+
+	passphrase, err := tokenPassphrase()
+	if err != nil {
+		return nil, err
+	}
+	dk, err := scrypt.Key([]byte(passphrase), salt, scryptN, scryptR, scryptP, scryptKeyLen)
+	if err != nil {
+		return nil, fmt.Errorf("unable to derive encryption key: %v", err)
+	}
+	block, err := aes.NewCipher(dk)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) < gcm.NonceSize() {
+		return nil, errors.New("encrypted token file is truncated")
+	}
+	nonce, ciphertext := rest[:gcm.NonceSize()], rest[gcm.NonceSize():]
+	data, err := gcm.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decrypt token (wrong passphrase?): %v", err)
+	}
+	return decodeToken(data)
+}
+
+func (s encryptedFileTokenStore) Save(key string, tok *oauth2.Token) error {
+	passphrase, err := tokenPassphrase()
+	if err != nil {
+		return err
+	}
+	salt := make([]byte, saltLen)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return fmt.Errorf("unable to generate salt: %v", err)
+	}
+	dk, err := scrypt.Key([]byte(passphrase), salt, scryptN, scryptR, scryptP, scryptKeyLen)
+	if err != nil {
+		return fmt.Errorf("unable to derive encryption key: %v", err)
+	}
+	block, err := aes.NewCipher(dk)
+	if err != nil {
+		return err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return fmt.Errorf("unable to generate nonce: %v", err)
+	}
+	data, err := encodeToken(tok)
+	if err != nil {
+		return err
+	}
+	ciphertext := gcm.Seal(nonce, nonce, data, nil)
+
+	blob := append(salt, ciphertext...)
+	return ioutil.WriteFile(s.path(key), blob, 0600)
+}